@@ -0,0 +1,82 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fi
+
+import (
+	"time"
+
+	"k8s.io/kops/util/pkg/vfs"
+)
+
+// SecretStore holds secrets, such as certificate private keys, API tokens
+// and kubeconfigs used to bootstrap a cluster. ClientsetSecretStore and
+// CoreSecretStore (both in upup/pkg/fi/secrets) and the VFS-backed store
+// all implement it.
+type SecretStore interface {
+	// FindSecret returns the named secret, or nil if it does not exist.
+	FindSecret(name string) (*Secret, error)
+
+	// ListSecrets returns the names of all secrets.
+	ListSecrets() ([]string, error)
+
+	// Secret returns the named secret, or an error if it does not exist.
+	Secret(name string) (*Secret, error)
+
+	// DeleteSecret deletes the specified secret.
+	DeleteSecret(item *KeystoreItem) error
+
+	// GetOrCreateSecret returns the named secret, creating it with the
+	// given value if it does not already exist.
+	GetOrCreateSecret(name string, secret *Secret) (*Secret, bool, error)
+
+	// VFSPath returns the path this store mirrors itself to, if any.
+	VFSPath() vfs.Path
+
+	// RotateSecret appends newData as the new primary version of name,
+	// demoting the previous primary to secondary so consumers that still
+	// trust it keep working through an overlap window. It returns the ids
+	// of the version that was demoted and the version that was created.
+	RotateSecret(name string, newData []byte) (oldID string, newID string, err error)
+
+	// ListSecretVersions returns every historical version on record for name.
+	ListSecretVersions(name string) ([]SecretVersion, error)
+
+	// FindSecretByID returns a specific historical version of name, or nil
+	// if that version doesn't exist.
+	FindSecretByID(name string, id string) (*Secret, error)
+
+	// PromoteSecret makes the version with the given id primary again,
+	// e.g. to roll back a rotation within its overlap window.
+	PromoteSecret(name string, id string) error
+
+	// PruneSecrets deletes secondary (non-primary) versions of name that
+	// were rotated out more than olderThan ago, always keeping at least
+	// the keep most recently rotated ones.
+	PruneSecrets(name string, keep int, olderThan time.Duration) error
+}
+
+// SecretVersion describes one historical version of a rotated secret.
+type SecretVersion struct {
+	// Id identifies the version; its meaning is backend-specific (e.g. a
+	// pki.Serial string for ClientsetSecretStore).
+	Id string
+	// Primary is true for the version consumers should use by default.
+	Primary bool
+	// RotatedAt is when this version was demoted from primary, or nil if
+	// it either is primary or predates rotation tracking.
+	RotatedAt *time.Time
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/kops/pkg/apis/kops"
+)
+
+// cacheSyncTimeout bounds how long a write waits to see itself reflected
+// in the informer cache before GetOrCreateSecret's round-trip guarantee
+// gives up and returns an error instead of hanging forever.
+const cacheSyncTimeout = 10 * time.Second
+
+var (
+	secretStoreCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kops_secretstore_cache_hits_total",
+		Help: "Number of ClientsetSecretStore reads served from the informer cache.",
+	})
+	secretStoreCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kops_secretstore_cache_misses_total",
+		Help: "Number of ClientsetSecretStore reads that went to the API server.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(secretStoreCacheHits, secretStoreCacheMisses)
+}
+
+// WithCache enables an opt-in, informer-backed read cache: FindSecret,
+// Secret and ListSecrets are served from a local, watch-updated cache.Store
+// instead of hitting the API server on every call. Writes still go through
+// the API and then wait for the informer to observe their own change
+// before returning, so GetOrCreateSecret's round-trip guarantee holds.
+func WithCache() ClientsetSecretStoreOption {
+	return func(c *ClientsetSecretStore) {
+		c.startCache()
+	}
+}
+
+func (c *ClientsetSecretStore) startCache() {
+	lw := &cache.ListWatch{
+		ListFunc: func(options v1.ListOptions) (runtime.Object, error) {
+			return c.clientset.Keysets(c.namespace).List(options)
+		},
+		WatchFunc: func(options v1.ListOptions) (watch.Interface, error) {
+			return c.clientset.Keysets(c.namespace).Watch(options)
+		},
+	}
+
+	informer := cache.NewSharedInformer(lw, &kops.Keyset{}, 0)
+
+	c.cache = informer.GetStore()
+	c.cacheController = informer
+	c.cacheStopCh = make(chan struct{})
+
+	go informer.Run(c.cacheStopCh)
+
+	if !cache.WaitForCacheSync(c.cacheStopCh, informer.HasSynced) {
+		glog.Warningf("timed out waiting for initial secret store cache sync in namespace %q", c.namespace)
+	}
+}
+
+// AddCacheEventHandler subscribes handler to the informer's add/update/delete
+// notifications, e.g. so a SecretMirror can resync as soon as a keyset
+// changes instead of polling. It returns an error if WithCache was not
+// enabled, since there is no informer to subscribe to in that case.
+func (c *ClientsetSecretStore) AddCacheEventHandler(handler cache.ResourceEventHandler) error {
+	if c.cacheController == nil {
+		return fmt.Errorf("AddCacheEventHandler requires the secret store to be built with WithCache")
+	}
+	c.cacheController.AddEventHandler(handler)
+	return nil
+}
+
+// Close tears down the informer started by WithCache. It is a no-op if
+// caching was never enabled.
+func (c *ClientsetSecretStore) Close() {
+	if c.cacheStopCh != nil {
+		close(c.cacheStopCh)
+		c.cacheStopCh = nil
+	}
+}
+
+// getCachedKeyset returns (keyset, true) if name is in the cache, or
+// (nil, false) if caching is disabled or the entry isn't cached, in which
+// case the caller should fall back to the API.
+func (c *ClientsetSecretStore) getCachedKeyset(fullName string) (*kops.Keyset, bool) {
+	if c.cache == nil {
+		return nil, false
+	}
+
+	obj, exists, err := c.cache.GetByKey(c.namespace + "/" + fullName)
+	if err != nil || !exists {
+		secretStoreCacheMisses.Inc()
+		return nil, false
+	}
+
+	keyset, ok := obj.(*kops.Keyset)
+	if !ok {
+		secretStoreCacheMisses.Inc()
+		return nil, false
+	}
+
+	secretStoreCacheHits.Inc()
+	return keyset, true
+}
+
+// waitForCacheObservation blocks until the informer cache either observes
+// fullName satisfying want, or cacheSyncTimeout elapses. It is a no-op if
+// caching is disabled.
+func (c *ClientsetSecretStore) waitForCacheObservation(fullName string, want func(keyset *kops.Keyset, exists bool) bool) error {
+	if c.cache == nil {
+		return nil
+	}
+
+	key := c.namespace + "/" + fullName
+	deadline := time.Now().Add(cacheSyncTimeout)
+	for {
+		obj, exists, _ := c.cache.GetByKey(key)
+		var keyset *kops.Keyset
+		if exists {
+			keyset, _ = obj.(*kops.Keyset)
+		}
+		if want(keyset, exists) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for secret store cache to observe change to %q", fullName)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/golang/glog"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/kops/pkg/apis/kops"
 	kopsinternalversion "k8s.io/kops/pkg/client/clientset_generated/clientset/typed/kops/internalversion"
 	"k8s.io/kops/pkg/pki"
@@ -38,16 +39,51 @@ const NamePrefix = "token-"
 type ClientsetSecretStore struct {
 	namespace string
 	clientset kopsinternalversion.KopsInterface
+	encrypter *SecretEncrypter
+
+	// cache, cacheController and cacheStopCh are only set when WithCache
+	// is passed to NewClientsetSecretStore; see cache.go.
+	cache           cache.Store
+	cacheController cache.SharedInformer
+	cacheStopCh     chan struct{}
+
+	// mirror, if attached with AttachMirror, backs VFSPath/MirrorPath.
+	mirror *SecretMirror
 }
 
 var _ fi.SecretStore = &ClientsetSecretStore{}
 
+// ClientsetSecretStoreOption configures a ClientsetSecretStore at construction time.
+type ClientsetSecretStoreOption func(*ClientsetSecretStore)
+
+// WithEncryption enables envelope encryption of PrivateMaterial using the
+// given KMS provider. Existing cleartext secrets remain readable;
+// createSecret only encrypts going forward.
+func WithEncryption(kms KMSProvider) ClientsetSecretStoreOption {
+	return func(c *ClientsetSecretStore) {
+		c.encrypter = NewSecretEncrypter(kms)
+	}
+}
+
+// WithMACOnlyEncryption is like WithEncryption, but leaves PrivateMaterial
+// in the clear and only MACs it, so mixed encrypted/cleartext keysets can
+// still have their integrity validated.
+func WithMACOnlyEncryption(kms KMSProvider) ClientsetSecretStoreOption {
+	return func(c *ClientsetSecretStore) {
+		c.encrypter = NewSecretEncrypter(kms)
+		c.encrypter.MACOnly = true
+	}
+}
+
 // NewClientsetSecretStore is the constructor for ClientsetSecretStore
-func NewClientsetSecretStore(clientset kopsinternalversion.KopsInterface, namespace string) fi.SecretStore {
+func NewClientsetSecretStore(clientset kopsinternalversion.KopsInterface, namespace string, options ...ClientsetSecretStoreOption) fi.SecretStore {
 	c := &ClientsetSecretStore{
 		clientset: clientset,
 		namespace: namespace,
 	}
+	for _, option := range options {
+		option(c)
+	}
 	return c
 }
 
@@ -62,15 +98,25 @@ func (c *ClientsetSecretStore) FindSecret(name string) (*fi.Secret, error) {
 
 // ListSecrets implements fi.SecretStore::ListSecrets
 func (c *ClientsetSecretStore) ListSecrets() ([]string, error) {
-	list, err := c.clientset.Keysets(c.namespace).List(v1.ListOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("error listing keysets: %v", err)
+	var keysets []*kops.Keyset
+	if c.cache != nil {
+		for _, obj := range c.cache.List() {
+			if keyset, ok := obj.(*kops.Keyset); ok {
+				keysets = append(keysets, keyset)
+			}
+		}
+	} else {
+		list, err := c.clientset.Keysets(c.namespace).List(v1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error listing keysets: %v", err)
+		}
+		for i := range list.Items {
+			keysets = append(keysets, &list.Items[i])
+		}
 	}
 
 	var names []string
-	for i := range list.Items {
-		keyset := &list.Items[i]
-
+	for _, keyset := range keysets {
 		switch keyset.Spec.Type {
 		case kops.SecretTypeSecret:
 			name := strings.TrimPrefix(keyset.Name, NamePrefix)
@@ -96,7 +142,21 @@ func (c *ClientsetSecretStore) Secret(name string) (*fi.Secret, error) {
 // DeleteSecret implements fi.SecretStore::DeleteSecret
 func (c *ClientsetSecretStore) DeleteSecret(item *fi.KeystoreItem) error {
 	client := c.clientset.Keysets(c.namespace)
-	return fi.DeleteKeysetItem(client, item.Name, kops.SecretTypeKeypair, item.Id)
+	if err := fi.DeleteKeysetItem(client, item.Name, kops.SecretTypeKeypair, item.Id); err != nil {
+		return err
+	}
+
+	return c.waitForCacheObservation(NamePrefix+item.Name, func(keyset *kops.Keyset, exists bool) bool {
+		if !exists {
+			return true
+		}
+		for i := range keyset.Spec.Keys {
+			if keyset.Spec.Keys[i].Id == item.Id {
+				return false
+			}
+		}
+		return true
+	})
 }
 
 // GetOrCreateSecret implements fi.SecretStore::GetOrCreateSecret
@@ -137,32 +197,57 @@ func (c *ClientsetSecretStore) GetOrCreateSecret(name string, secret *fi.Secret)
 
 // loadSecret returns the named secret, if it exists, otherwise returns nil
 func (c *ClientsetSecretStore) loadSecret(name string) (*fi.Secret, error) {
-	name = NamePrefix + name
-	keyset, err := c.clientset.Keysets(c.namespace).Get(name, v1.GetOptions{})
+	fullName := NamePrefix + name
+
+	if keyset, ok := c.getCachedKeyset(fullName); ok {
+		return c.parseSecret(keyset)
+	}
+
+	keyset, err := c.clientset.Keysets(c.namespace).Get(fullName, v1.GetOptions{})
 	if err != nil {
 		if errors.IsNotFound(err) {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("error reading keyset %q: %v", name, err)
+		return nil, fmt.Errorf("error reading keyset %q: %v", fullName, err)
 	}
 
-	return parseSecret(keyset)
+	return c.parseSecret(keyset)
 }
 
-// parseSecret attempts to parse the primary secret, otherwise returns nil
-func parseSecret(keyset *kops.Keyset) (*fi.Secret, error) {
+// parseSecret attempts to parse the primary secret, otherwise returns nil.
+// If encryption is configured, it transparently decrypts PrivateMaterial;
+// material that isn't an envelope is returned as-is so existing cleartext
+// secrets keep working.
+func (c *ClientsetSecretStore) parseSecret(keyset *kops.Keyset) (*fi.Secret, error) {
 	primary := fi.FindPrimary(keyset)
 	if primary == nil {
 		return nil, nil
 	}
 
+	data := primary.PrivateMaterial
+	if c.encrypter != nil {
+		plaintext, wasEnveloped, err := c.encrypter.Decrypt(data)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting secret %q: %v", keyset.Name, err)
+		}
+		if wasEnveloped {
+			data = plaintext
+		}
+	}
+
 	s := &fi.Secret{}
-	s.Data = primary.PrivateMaterial
+	s.Data = data
 	return s, nil
 }
 
 // createSecret writes the secret, but only if it does not exist
 func (c *ClientsetSecretStore) createSecret(s *fi.Secret, name string) (*kops.Keyset, error) {
+	if schema, ok := secretSchemas[name]; ok {
+		if err := schema.Validate(s.Data); err != nil {
+			return nil, fmt.Errorf("invalid secret %q: %v", name, err)
+		}
+	}
+
 	keyset := &kops.Keyset{}
 	keyset.Name = NamePrefix + name
 	keyset.Spec.Type = kops.SecretTypeSecret
@@ -170,17 +255,115 @@ func (c *ClientsetSecretStore) createSecret(s *fi.Secret, name string) (*kops.Ke
 	t := time.Now().UnixNano()
 	id := pki.BuildPKISerial(t)
 
+	privateMaterial := s.Data
+	if c.encrypter != nil {
+		encrypted, err := c.encrypter.Encrypt(s.Data)
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting secret %q: %v", name, err)
+		}
+		privateMaterial = encrypted
+	}
+
 	keyset.Spec.Keys = append(keyset.Spec.Keys, kops.KeysetItem{
 		Id:              id.String(),
-		PrivateMaterial: s.Data,
+		PrivateMaterial: privateMaterial,
 	})
 
-	return c.clientset.Keysets(c.namespace).Create(keyset)
+	created, err := c.clientset.Keysets(c.namespace).Create(keyset)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.waitForCacheObservation(keyset.Name, func(keyset *kops.Keyset, exists bool) bool {
+		return exists
+	}); err != nil {
+		return nil, err
+	}
+
+	return created, nil
 }
 
-// VFSPath implements fi.SecretStore::VFSPath
-func (c *ClientsetSecretStore) VFSPath() vfs.Path {
-	// We will implement mirroring instead
-	glog.Fatalf("ClientsetSecretStore::VFSPath not implemented")
+// ImportSecret validates data against name's registered SecretSchema, if
+// any, and then stores it. Unlike GetOrCreateSecret, which treats an
+// existing value as success, ImportSecret is an explicit operator action
+// and fails if name already exists -- use RotateSecret to replace it.
+func (c *ClientsetSecretStore) ImportSecret(name string, data []byte) error {
+	existing, err := c.FindSecret(name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("secret %q already exists; use RotateSecret to replace it", name)
+	}
+
+	_, err = c.createSecret(&fi.Secret{Data: data}, name)
+	return err
+}
+
+// UpdateKeys re-wraps the DEK of every secret's PrivateMaterial under
+// newKMS without re-encrypting or touching the ciphertext itself, mirroring
+// sops's "updatekeys" operation for rotating which recipients can open a
+// store after the KMS key/recipient set changes. Items that aren't
+// envelope-encrypted (legacy cleartext secrets coexisting with encrypted
+// ones) are left untouched rather than treated as an error.
+func (c *ClientsetSecretStore) UpdateKeys(newKMS KMSProvider) error {
+	if c.encrypter == nil {
+		return fmt.Errorf("no encryption provider configured on this secret store")
+	}
+
+	list, err := c.clientset.Keysets(c.namespace).List(v1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing keysets: %v", err)
+	}
+
+	for i := range list.Items {
+		keyset := &list.Items[i]
+		if keyset.Spec.Type != kops.SecretTypeSecret {
+			continue
+		}
+
+		changed := false
+		for j := range keyset.Spec.Keys {
+			item := &keyset.Spec.Keys[j]
+			rewrapped, wasEnveloped, err := c.encrypter.rewrapDEK(item.PrivateMaterial, newKMS)
+			if err != nil {
+				return fmt.Errorf("error re-wrapping key %q/%q: %v", keyset.Name, item.Id, err)
+			}
+			if !wasEnveloped {
+				continue
+			}
+			item.PrivateMaterial = rewrapped
+			changed = true
+		}
+
+		if changed {
+			updated, err := c.clientset.Keysets(c.namespace).Update(keyset)
+			if err != nil {
+				return fmt.Errorf("error updating keyset %q: %v", keyset.Name, err)
+			}
+			if err := c.waitForCacheObservation(keyset.Name, func(cached *kops.Keyset, exists bool) bool {
+				return exists && cached.ResourceVersion == updated.ResourceVersion
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	macOnly := c.encrypter.MACOnly
+	c.encrypter = NewSecretEncrypter(newKMS)
+	c.encrypter.MACOnly = macOnly
 	return nil
 }
+
+// VFSPath implements fi.SecretStore::VFSPath. It returns the attached
+// mirror's root, if any (see AttachMirror); callers that want to
+// distinguish "no mirror configured" from a real error should use
+// MirrorPath instead, which returns ErrNoMirror rather than a nil Path.
+func (c *ClientsetSecretStore) VFSPath() vfs.Path {
+	path, err := c.MirrorPath()
+	if err != nil {
+		glog.Warningf("%v", err)
+		return nil
+	}
+	return path
+}
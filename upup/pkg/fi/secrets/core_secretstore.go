@@ -0,0 +1,298 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	kopsinternalversion "k8s.io/kops/pkg/client/clientset_generated/clientset/typed/kops/internalversion"
+	"k8s.io/kops/pkg/pki"
+	"k8s.io/kops/upup/pkg/fi"
+	"k8s.io/kops/util/pkg/vfs"
+)
+
+// coreSecretType marks the v1.Secret objects CoreSecretStore owns, so
+// ListSecrets can filter them out from anything else living in the
+// namespace.
+const coreSecretType v1.SecretType = "kops.k8s.io/secret"
+
+// coreSecretNameLabel records the logical (unprefixed) kops secret name, since
+// CoreSecretStore names the underlying v1.Secret after NamePrefix + name,
+// the same way ClientsetSecretStore names Keysets.
+const coreSecretNameLabel = "kops.k8s.io/secret-name"
+
+// corePrimaryAnnotation records which version (see coreDataKey) is primary.
+// Unlike ClientsetSecretStore's Keysets, where primary is implicit (the
+// item with the most recent Id), CoreSecretStore makes it explicit, since
+// a v1.Secret has no equivalent of KeysetItem to order.
+const corePrimaryAnnotation = "primary.secrets.kops.k8s.io"
+
+// coreMaterialKeyPrefix namespaces per-version payloads within
+// Secret.Data, which holds every rotated version side by side so history
+// survives without a second object per version.
+const coreMaterialKeyPrefix = "material."
+
+// coreDataKey is the Secret.Data key holding the gzipped payload for
+// version id.
+func coreDataKey(id string) string {
+	return coreMaterialKeyPrefix + id
+}
+
+// CoreSecretStore is a SecretStore backed by plain core/v1 Secret objects,
+// for users who don't want to install the kops Keyset CRD and would rather
+// rely on tooling that already understands Secrets (kubectl, RBAC,
+// admission webhooks, ExternalSecrets, etc). Select it by passing
+// BackendCoreSecret to NewSecretStore; this package defines no command-line
+// flag for the choice.
+type CoreSecretStore struct {
+	namespace string
+	clientset kubernetes.Interface
+}
+
+var _ fi.SecretStore = &CoreSecretStore{}
+
+// NewCoreSecretStore is the constructor for CoreSecretStore.
+func NewCoreSecretStore(clientset kubernetes.Interface, namespace string) fi.SecretStore {
+	return &CoreSecretStore{
+		clientset: clientset,
+		namespace: namespace,
+	}
+}
+
+// Backend identifies which SecretStore implementation NewSecretStore
+// constructs.
+type Backend string
+
+const (
+	// BackendKeyset is the default backend: Keyset CRDs (ClientsetSecretStore).
+	BackendKeyset Backend = "keyset"
+	// BackendCoreSecret stores secrets as plain core/v1 Secret objects (CoreSecretStore).
+	BackendCoreSecret Backend = "coresecret"
+)
+
+// NewSecretStore builds the configured SecretStore backend. coreClientset
+// is only required when backend is BackendCoreSecret.
+func NewSecretStore(backend Backend, clientset kopsinternalversion.KopsInterface, coreClientset kubernetes.Interface, namespace string) (fi.SecretStore, error) {
+	switch backend {
+	case "", BackendKeyset:
+		return NewClientsetSecretStore(clientset, namespace), nil
+	case BackendCoreSecret:
+		if coreClientset == nil {
+			return nil, fmt.Errorf("--secret-store=coresecret requires a core/v1 clientset")
+		}
+		return NewCoreSecretStore(coreClientset, namespace), nil
+	default:
+		return nil, fmt.Errorf("unknown secret store backend %q", backend)
+	}
+}
+
+// FindSecret implements fi.SecretStore::FindSecret
+func (c *CoreSecretStore) FindSecret(name string) (*fi.Secret, error) {
+	secret, err := c.clientset.CoreV1().Secrets(c.namespace).Get(NamePrefix+name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading secret %q: %v", name, err)
+	}
+
+	primaryID := secret.Annotations[corePrimaryAnnotation]
+	if primaryID == "" {
+		return nil, fmt.Errorf("secret %q has no primary version recorded", name)
+	}
+
+	raw, ok := secret.Data[coreDataKey(primaryID)]
+	if !ok {
+		return nil, fmt.Errorf("secret %q is missing its primary version %q", name, primaryID)
+	}
+
+	data, err := decodeCoreSecretData(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding secret %q: %v", name, err)
+	}
+
+	return &fi.Secret{Data: data}, nil
+}
+
+// ListSecrets implements fi.SecretStore::ListSecrets
+func (c *CoreSecretStore) ListSecrets() ([]string, error) {
+	list, err := c.clientset.CoreV1().Secrets(c.namespace).List(metav1.ListOptions{
+		LabelSelector: "owner=kops",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing secrets: %v", err)
+	}
+
+	var names []string
+	for i := range list.Items {
+		secret := &list.Items[i]
+		if secret.Type != coreSecretType {
+			continue
+		}
+		name := secret.Labels[coreSecretNameLabel]
+		if name == "" {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Secret implements fi.SecretStore::Secret
+func (c *CoreSecretStore) Secret(name string) (*fi.Secret, error) {
+	s, err := c.FindSecret(name)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("Secret not found: %q", name)
+	}
+	return s, nil
+}
+
+// DeleteSecret implements fi.SecretStore::DeleteSecret. Only the version
+// identified by item.Id is removed, the same way ClientsetSecretStore
+// targets a single KeysetItem; the underlying v1.Secret itself is only
+// deleted once no versions remain, since rotation can leave several
+// versions side by side in Secret.Data.
+func (c *CoreSecretStore) DeleteSecret(item *fi.KeystoreItem) error {
+	fullName := NamePrefix + item.Name
+	secret, err := c.clientset.CoreV1().Secrets(c.namespace).Get(fullName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading secret %q: %v", fullName, err)
+	}
+
+	delete(secret.Data, coreDataKey(item.Id))
+	delete(secret.Annotations, rotatedAtAnnotationPrefix+item.Id)
+
+	if len(secret.Data) == 0 {
+		return c.clientset.CoreV1().Secrets(c.namespace).Delete(fullName, &metav1.DeleteOptions{})
+	}
+
+	_, err = c.clientset.CoreV1().Secrets(c.namespace).Update(secret)
+	return err
+}
+
+// GetOrCreateSecret implements fi.SecretStore::GetOrCreateSecret
+func (c *CoreSecretStore) GetOrCreateSecret(name string, secret *fi.Secret) (*fi.Secret, bool, error) {
+	for i := 0; i < 2; i++ {
+		s, err := c.FindSecret(name)
+		if err != nil {
+			return nil, false, err
+		}
+		if s != nil {
+			return s, false, nil
+		}
+
+		_, err = c.createSecret(secret, name)
+		if err != nil {
+			if errors.IsAlreadyExists(err) && i == 0 {
+				glog.Infof("Got already-exists error when writing secret; likely due to concurrent creation.  Will retry")
+				continue
+			}
+			return nil, false, err
+		}
+		break
+	}
+
+	// Make double-sure it round-trips
+	s, err := c.FindSecret(name)
+	if err != nil {
+		glog.Fatalf("unable to load secret immmediately after creation %v: %v", name, err)
+		return nil, false, err
+	}
+	return s, true, nil
+}
+
+// createSecret writes the secret as a v1.Secret, gzip-compressed so
+// arbitrary binary PKI material survives the round trip. The first version
+// is immediately marked primary.
+func (c *CoreSecretStore) createSecret(s *fi.Secret, name string) (*v1.Secret, error) {
+	if schema, ok := secretSchemas[name]; ok {
+		if err := schema.Validate(s.Data); err != nil {
+			return nil, fmt.Errorf("invalid secret %q: %v", name, err)
+		}
+	}
+
+	id := pki.BuildPKISerial(time.Now().UnixNano()).String()
+
+	data, err := encodeCoreSecretData(s.Data)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding secret %q: %v", name, err)
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      NamePrefix + name,
+			Namespace: c.namespace,
+			Labels: map[string]string{
+				"owner":             "kops",
+				coreSecretNameLabel: name,
+			},
+			Annotations: map[string]string{
+				corePrimaryAnnotation: id,
+			},
+		},
+		Type: coreSecretType,
+		Data: map[string][]byte{
+			coreDataKey(id): data,
+		},
+	}
+
+	return c.clientset.CoreV1().Secrets(c.namespace).Create(secret)
+}
+
+// VFSPath implements fi.SecretStore::VFSPath. CoreSecretStore has no
+// mirror, so it always returns nil.
+func (c *CoreSecretStore) VFSPath() vfs.Path {
+	return nil
+}
+
+func encodeCoreSecretData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeCoreSecretData(raw []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
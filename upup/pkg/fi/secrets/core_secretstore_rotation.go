@@ -0,0 +1,197 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kops/pkg/pki"
+	"k8s.io/kops/upup/pkg/fi"
+)
+
+// RotateSecret implements fi.SecretStore::RotateSecret for CoreSecretStore:
+// it adds newData as a new Secret.Data entry and repoints corePrimaryAnnotation
+// at it, recording when the previous primary was demoted.
+func (c *CoreSecretStore) RotateSecret(name string, newData []byte) (oldID string, newID string, err error) {
+	if schema, ok := secretSchemas[name]; ok {
+		if err := schema.Validate(newData); err != nil {
+			return "", "", fmt.Errorf("invalid secret %q: %v", name, err)
+		}
+	}
+
+	fullName := NamePrefix + name
+	secret, err := c.clientset.CoreV1().Secrets(c.namespace).Get(fullName, metav1.GetOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("error reading secret %q: %v", fullName, err)
+	}
+
+	data, err := encodeCoreSecretData(newData)
+	if err != nil {
+		return "", "", fmt.Errorf("error encoding secret %q: %v", name, err)
+	}
+
+	t := time.Now()
+	newID = pki.BuildPKISerial(t.UnixNano()).String()
+
+	oldID = secret.Annotations[corePrimaryAnnotation]
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[coreDataKey(newID)] = data
+
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	if oldID != "" {
+		secret.Annotations = setRotatedAt(secret.Annotations, oldID, t)
+	}
+	secret.Annotations[corePrimaryAnnotation] = newID
+
+	if _, err := c.clientset.CoreV1().Secrets(c.namespace).Update(secret); err != nil {
+		return "", "", fmt.Errorf("error updating secret %q: %v", fullName, err)
+	}
+
+	return oldID, newID, nil
+}
+
+// PromoteSecret implements fi.SecretStore::PromoteSecret for CoreSecretStore.
+// Since primary is an explicit annotation here (unlike the Keyset-backed
+// store's implicit "most recent wins"), promoting just repoints it.
+func (c *CoreSecretStore) PromoteSecret(name string, id string) error {
+	fullName := NamePrefix + name
+	secret, err := c.clientset.CoreV1().Secrets(c.namespace).Get(fullName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error reading secret %q: %v", fullName, err)
+	}
+
+	if _, ok := secret.Data[coreDataKey(id)]; !ok {
+		return fmt.Errorf("no version %q found for secret %q", id, name)
+	}
+
+	current := secret.Annotations[corePrimaryAnnotation]
+	if current == id {
+		return nil
+	}
+
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	if current != "" {
+		secret.Annotations = setRotatedAt(secret.Annotations, current, time.Now())
+	}
+	delete(secret.Annotations, rotatedAtAnnotationPrefix+id)
+	secret.Annotations[corePrimaryAnnotation] = id
+
+	_, err = c.clientset.CoreV1().Secrets(c.namespace).Update(secret)
+	return err
+}
+
+// FindSecretByID implements fi.SecretStore::FindSecretByID for CoreSecretStore.
+func (c *CoreSecretStore) FindSecretByID(name string, id string) (*fi.Secret, error) {
+	fullName := NamePrefix + name
+	secret, err := c.clientset.CoreV1().Secrets(c.namespace).Get(fullName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading secret %q: %v", fullName, err)
+	}
+
+	raw, ok := secret.Data[coreDataKey(id)]
+	if !ok {
+		return nil, nil
+	}
+
+	data, err := decodeCoreSecretData(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding secret %q version %q: %v", name, id, err)
+	}
+
+	return &fi.Secret{Data: data}, nil
+}
+
+// ListSecretVersions implements fi.SecretStore::ListSecretVersions for CoreSecretStore.
+func (c *CoreSecretStore) ListSecretVersions(name string) ([]fi.SecretVersion, error) {
+	fullName := NamePrefix + name
+	secret, err := c.clientset.CoreV1().Secrets(c.namespace).Get(fullName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading secret %q: %v", fullName, err)
+	}
+
+	primaryID := secret.Annotations[corePrimaryAnnotation]
+
+	var versions []fi.SecretVersion
+	for key := range secret.Data {
+		id := strings.TrimPrefix(key, coreMaterialKeyPrefix)
+		if id == key {
+			continue // not a version entry
+		}
+
+		version := fi.SecretVersion{Id: id, Primary: id == primaryID}
+		if t, ok := rotatedAt(secret.Annotations, id); ok {
+			version.RotatedAt = &t
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+// PruneSecrets implements fi.SecretStore::PruneSecrets for CoreSecretStore,
+// using the same keep/olderThan selection logic as ClientsetSecretStore.
+func (c *CoreSecretStore) PruneSecrets(name string, keep int, olderThan time.Duration) error {
+	fullName := NamePrefix + name
+	secret, err := c.clientset.CoreV1().Secrets(c.namespace).Get(fullName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error reading secret %q: %v", fullName, err)
+	}
+
+	primaryID := secret.Annotations[corePrimaryAnnotation]
+
+	var secondaries []secondaryVersion
+	for key := range secret.Data {
+		id := strings.TrimPrefix(key, coreMaterialKeyPrefix)
+		if id == key || id == primaryID {
+			continue
+		}
+		t, ok := rotatedAt(secret.Annotations, id)
+		if !ok {
+			continue
+		}
+		secondaries = append(secondaries, secondaryVersion{id: id, rotatedAt: t})
+	}
+
+	remove := selectPruneTargets(secondaries, keep, olderThan, time.Now())
+	if len(remove) == 0 {
+		return nil
+	}
+
+	for id := range remove {
+		delete(secret.Data, coreDataKey(id))
+		delete(secret.Annotations, rotatedAtAnnotationPrefix+id)
+	}
+
+	_, err = c.clientset.CoreV1().Secrets(c.namespace).Update(secret)
+	return err
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// envelopeMagic marks an envelope-encrypted PrivateMaterial blob. None of
+// the well-known kops secret formats (PEM, kubeconfig YAML, raw tokens)
+// begin with a NUL byte, so prefixing every envelope with one lets us tell
+// encrypted and legacy cleartext secrets apart without a migration.
+const envelopeMagic byte = 0x00
+
+// envelopeVersionSealed is an AES-GCM encrypted envelope: the DEK both
+// encrypts and authenticates PrivateMaterial.
+const envelopeVersionSealed byte = 1
+
+// envelopeVersionMACOnly is a MAC-only envelope: PrivateMaterial stays in
+// the clear, but a MAC over it (keyed by the DEK) lets callers detect
+// tampering even when they have chosen not to encrypt. This keeps a
+// keyset's items self-consistent when some were written before encryption
+// was turned on and others after.
+const envelopeVersionMACOnly byte = 2
+
+// KMSProvider wraps and unwraps a per-secret data-encryption-key (DEK)
+// using an external key-management system. SecretEncrypter never sees the
+// master key; it only ever handles the (small) wrapped DEK. The only
+// implementation in this package is LocalKMSProvider, which wraps DEKs with
+// a locally held AES master key; there is no AWS KMS, GCP KMS, Azure Key
+// Vault or age/PGP provider here.
+type KMSProvider interface {
+	// Name identifies the provider in the envelope header, e.g. "awskms".
+	// UpdateKeys refuses to unwrap a DEK wrapped by a different provider.
+	Name() string
+
+	// WrapKey encrypts a DEK for storage alongside the ciphertext.
+	WrapKey(dek []byte) ([]byte, error)
+
+	// UnwrapKey recovers a DEK previously returned by WrapKey.
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// SecretEncrypter envelope-encrypts KeysetItem.PrivateMaterial: a random
+// DEK encrypts the material with AES-GCM, and the DEK itself is wrapped by
+// a KMSProvider, so ClientsetSecretStore never has to hold (or even see)
+// a long-lived master key.
+type SecretEncrypter struct {
+	KMS KMSProvider
+
+	// MACOnly skips AES-GCM encryption and only MACs PrivateMaterial,
+	// leaving it readable by anything that can read the Keyset. Useful
+	// when operators want tamper-evidence without restricting read
+	// access any further than etcd/API RBAC already does.
+	MACOnly bool
+}
+
+// NewSecretEncrypter returns a SecretEncrypter backed by the given KMS
+// provider.
+func NewSecretEncrypter(kms KMSProvider) *SecretEncrypter {
+	return &SecretEncrypter{KMS: kms}
+}
+
+// Encrypt returns an envelope that is safe to store directly in
+// KeysetItem.PrivateMaterial.
+func (e *SecretEncrypter) Encrypt(plaintext []byte) ([]byte, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, fmt.Errorf("error generating data encryption key: %v", err)
+	}
+
+	wrappedDEK, err := e.KMS.WrapKey(dek)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping data encryption key with %s: %v", e.KMS.Name(), err)
+	}
+
+	if e.MACOnly {
+		tag := macOver(dek, plaintext)
+		return encodeEnvelope(envelopeVersionMACOnly, e.KMS.Name(), wrappedDEK, nil, tag, plaintext), nil
+	}
+
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing AES cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing AES-GCM: %v", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %v", err)
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, plaintext, nil)
+	tag := macOver(dek, ciphertext)
+
+	return encodeEnvelope(envelopeVersionSealed, e.KMS.Name(), wrappedDEK, nonce, tag, ciphertext), nil
+}
+
+// Decrypt reverses Encrypt. The second return value is false if data does
+// not look like an envelope at all, so callers can fall back to treating
+// it as a pre-existing cleartext secret.
+func (e *SecretEncrypter) Decrypt(data []byte) ([]byte, bool, error) {
+	env, ok := decodeEnvelope(data)
+	if !ok {
+		return nil, false, nil
+	}
+
+	if env.provider != e.KMS.Name() {
+		return nil, true, fmt.Errorf("secret was wrapped with KMS provider %q, but %q is configured", env.provider, e.KMS.Name())
+	}
+
+	dek, err := e.KMS.UnwrapKey(env.wrappedDEK)
+	if err != nil {
+		return nil, true, fmt.Errorf("error unwrapping data encryption key with %s: %v", e.KMS.Name(), err)
+	}
+
+	if !hmac.Equal(macOver(dek, env.payload), env.tag) {
+		return nil, true, fmt.Errorf("MAC mismatch on encrypted secret; ciphertext may be corrupt or tampered with")
+	}
+
+	if env.version == envelopeVersionMACOnly {
+		return env.payload, true, nil
+	}
+
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, true, fmt.Errorf("error initializing AES cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, true, fmt.Errorf("error initializing AES-GCM: %v", err)
+	}
+
+	plaintext, err := gcm.Open(nil, env.nonce, env.payload, nil)
+	if err != nil {
+		return nil, true, fmt.Errorf("error decrypting secret: %v", err)
+	}
+
+	return plaintext, true, nil
+}
+
+// rewrapDEK unwraps data's DEK with the current provider and re-wraps it
+// with newKMS, leaving the ciphertext/MAC untouched. It backs
+// ClientsetSecretStore.UpdateKeys, which is the moral equivalent of sops's
+// "updatekeys" operation. Like Decrypt, the second return value is false
+// if data isn't an envelope at all, so UpdateKeys can skip legacy
+// cleartext items in a mixed keyset instead of treating them as an error.
+func (e *SecretEncrypter) rewrapDEK(data []byte, newKMS KMSProvider) ([]byte, bool, error) {
+	env, ok := decodeEnvelope(data)
+	if !ok {
+		return nil, false, nil
+	}
+	if env.provider != e.KMS.Name() {
+		return nil, true, fmt.Errorf("secret was wrapped with KMS provider %q, but %q is configured", env.provider, e.KMS.Name())
+	}
+
+	dek, err := e.KMS.UnwrapKey(env.wrappedDEK)
+	if err != nil {
+		return nil, true, fmt.Errorf("error unwrapping data encryption key with %s: %v", e.KMS.Name(), err)
+	}
+
+	wrappedDEK, err := newKMS.WrapKey(dek)
+	if err != nil {
+		return nil, true, fmt.Errorf("error wrapping data encryption key with %s: %v", newKMS.Name(), err)
+	}
+
+	return encodeEnvelope(env.version, newKMS.Name(), wrappedDEK, env.nonce, env.tag, env.payload), true, nil
+}
+
+func macOver(dek, data []byte) []byte {
+	mac := hmac.New(sha256.New, dek)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// envelope is the decoded form of an encrypted PrivateMaterial blob.
+type envelope struct {
+	version    byte
+	provider   string
+	wrappedDEK []byte
+	nonce      []byte
+	tag        []byte
+	payload    []byte // ciphertext (sealed) or plaintext (MAC-only)
+}
+
+func encodeEnvelope(version byte, provider string, wrappedDEK, nonce, tag, payload []byte) []byte {
+	var buf []byte
+	buf = append(buf, envelopeMagic, version)
+	buf = appendLengthPrefixed(buf, []byte(provider))
+	buf = appendLengthPrefixed(buf, wrappedDEK)
+	buf = appendLengthPrefixed(buf, nonce)
+	buf = appendLengthPrefixed(buf, tag)
+	buf = append(buf, payload...)
+	return buf
+}
+
+func decodeEnvelope(data []byte) (*envelope, bool) {
+	if len(data) < 2 || data[0] != envelopeMagic {
+		return nil, false
+	}
+	version := data[1]
+	if version != envelopeVersionSealed && version != envelopeVersionMACOnly {
+		return nil, false
+	}
+	rest := data[2:]
+
+	provider, rest, ok := readLengthPrefixed(rest)
+	if !ok {
+		return nil, false
+	}
+	wrappedDEK, rest, ok := readLengthPrefixed(rest)
+	if !ok {
+		return nil, false
+	}
+	nonce, rest, ok := readLengthPrefixed(rest)
+	if !ok {
+		return nil, false
+	}
+	tag, rest, ok := readLengthPrefixed(rest)
+	if !ok {
+		return nil, false
+	}
+
+	return &envelope{
+		version:    version,
+		provider:   string(provider),
+		wrappedDEK: wrappedDEK,
+		nonce:      nonce,
+		tag:        tag,
+		payload:    rest,
+	}, true
+}
+
+func appendLengthPrefixed(buf, field []byte) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+	buf = append(buf, length[:]...)
+	return append(buf, field...)
+}
+
+func readLengthPrefixed(data []byte) ([]byte, []byte, bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(data[:4])
+	data = data[4:]
+	if uint32(len(data)) < n {
+		return nil, nil, false
+	}
+	return data[:n], data[n:], true
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/kops/upup/pkg/fi"
+	"k8s.io/kops/util/pkg/vfs"
+)
+
+// ErrNoMirror is returned by MirrorPath when no SecretMirror has been
+// attached to the store, so callers can fall back gracefully instead of
+// treating a nil vfs.Path as success.
+var ErrNoMirror = fmt.Errorf("no secret mirror configured on this secret store")
+
+// SecretMirror replicates the secrets read by a ClientsetSecretStore out to
+// a vfs.Path (S3, GCS, Swift, local file), so nodes bootstrapping from the
+// state store can read secrets without talking to the API server. Each
+// secret version is written under <root>/secrets/<name>/<id> -- in the
+// form the Keyset stores it (an AES-GCM envelope, a MAC-only envelope with
+// cleartext payload, or plain cleartext), since the mirror copies each
+// KeysetItem's raw PrivateMaterial directly, rather than going through the
+// decrypting FindSecretByID accessor -- with a "primary"
+// pointer file recording which id is current, and a checksum manifest at
+// the root so bootstrapping nodes can detect drift.
+type SecretMirror struct {
+	store *ClientsetSecretStore
+	root  vfs.Path
+}
+
+// NewSecretMirror builds a mirror of store rooted at root. Call
+// ClientsetSecretStore.AttachMirror afterwards so VFSPath() picks it up.
+func NewSecretMirror(store *ClientsetSecretStore, root vfs.Path) *SecretMirror {
+	return &SecretMirror{store: store, root: root}
+}
+
+// Sync performs a one-shot reconciliation of every secret to the mirror.
+func (m *SecretMirror) Sync(ctx context.Context) error {
+	names, err := m.store.ListSecrets()
+	if err != nil {
+		return fmt.Errorf("error listing secrets to mirror: %v", err)
+	}
+
+	manifest := map[string]string{}
+	for _, name := range names {
+		fullName := NamePrefix + name
+		keyset, err := m.store.clientset.Keysets(m.store.namespace).Get(fullName, v1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("error reading keyset %q: %v", fullName, err)
+		}
+
+		primary := fi.FindPrimary(keyset)
+
+		for i := range keyset.Spec.Keys {
+			item := &keyset.Spec.Keys[i]
+
+			path := m.root.Join("secrets", name, item.Id)
+			if err := path.WriteFile(item.PrivateMaterial, nil); err != nil {
+				return fmt.Errorf("error writing mirrored secret %q/%q: %v", name, item.Id, err)
+			}
+			manifest[name+"/"+item.Id] = checksumOf(item.PrivateMaterial)
+
+			if primary != nil && item.Id == primary.Id {
+				primaryPath := m.root.Join("secrets", name, "primary")
+				if err := primaryPath.WriteFile([]byte(item.Id), nil); err != nil {
+					return fmt.Errorf("error writing primary pointer for %q: %v", name, err)
+				}
+			}
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding mirror manifest: %v", err)
+	}
+	if err := m.root.Join("manifest.json").WriteFile(manifestData, nil); err != nil {
+		return fmt.Errorf("error writing mirror manifest: %v", err)
+	}
+
+	return nil
+}
+
+// Run mirrors continuously until ctx is cancelled. If store was built with
+// WithCache, Run subscribes to the informer's add/update/delete events and
+// resyncs as soon as one arrives; interval otherwise (and always, as a
+// fallback) bounds how long a change can go unmirrored. Resyncs run one at
+// a time in this loop, and each one rewrites every version, primary pointer
+// and the manifest from the current keysets; files of versions that no
+// longer exist are not removed, though the manifest stops listing them.
+func (m *SecretMirror) Run(ctx context.Context, interval time.Duration) error {
+	changed := make(chan struct{}, 1)
+	notify := func(interface{}) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	if err := m.store.AddCacheEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(oldObj, newObj interface{}) { notify(newObj) },
+		DeleteFunc: notify,
+	}); err != nil {
+		glog.Warningf("secret mirror is polling every %s instead of watching for changes: %v", interval, err)
+	}
+
+	for {
+		if err := m.Sync(ctx); err != nil {
+			glog.Warningf("error syncing secret mirror: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func checksumOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AttachMirror configures the mirror that VFSPath()/MirrorPath() report.
+func (c *ClientsetSecretStore) AttachMirror(mirror *SecretMirror) {
+	c.mirror = mirror
+}
+
+// MirrorPath returns the attached mirror's root, or ErrNoMirror if none is
+// configured.
+func (c *ClientsetSecretStore) MirrorPath() (vfs.Path, error) {
+	if c.mirror == nil {
+		return nil, ErrNoMirror
+	}
+	return c.mirror.root, nil
+}
@@ -0,0 +1,326 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kops/pkg/apis/kops"
+	"k8s.io/kops/pkg/pki"
+	"k8s.io/kops/upup/pkg/fi"
+)
+
+// rotatedAtAnnotationPrefix records, per KeysetItem Id, the time it was
+// demoted from primary. kops.KeysetItem doesn't carry a rotation
+// timestamp field, so rather than migrate the CRD schema we stash it on
+// the Keyset's annotations, keyed by item Id. This is read by
+// ListSecretVersions and PruneSecrets; it is not set for items that
+// predate this feature, which PruneSecrets treats as "keep, unknown age".
+const rotatedAtAnnotationPrefix = "rotated-at.secrets.kops.k8s.io/"
+
+// RotateSecret appends newData as a new, primary KeysetItem and demotes the
+// current primary (if any) to secondary, recording when the rotation
+// happened. Consumers that still trust the old value can keep reading it
+// via FindSecretByID until it is pruned with PruneSecrets.
+func (c *ClientsetSecretStore) RotateSecret(name string, newData []byte) (oldID string, newID string, err error) {
+	if schema, ok := secretSchemas[name]; ok {
+		if err := schema.Validate(newData); err != nil {
+			return "", "", fmt.Errorf("invalid secret %q: %v", name, err)
+		}
+	}
+
+	fullName := NamePrefix + name
+	keyset, err := c.clientset.Keysets(c.namespace).Get(fullName, v1.GetOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("error reading keyset %q: %v", fullName, err)
+	}
+
+	old := fi.FindPrimary(keyset)
+
+	t := time.Now()
+	id := pki.BuildPKISerial(t.UnixNano())
+	newID = id.String()
+
+	privateMaterial := newData
+	if c.encrypter != nil {
+		encrypted, err := c.encrypter.Encrypt(newData)
+		if err != nil {
+			return "", "", fmt.Errorf("error encrypting secret %q: %v", name, err)
+		}
+		privateMaterial = encrypted
+	}
+
+	keyset.Spec.Keys = append(keyset.Spec.Keys, kops.KeysetItem{
+		Id:              newID,
+		PrivateMaterial: privateMaterial,
+	})
+
+	if old != nil {
+		oldID = old.Id
+		keyset.Annotations = setRotatedAt(keyset.Annotations, oldID, t)
+	}
+
+	if _, err := c.clientset.Keysets(c.namespace).Update(keyset); err != nil {
+		return "", "", fmt.Errorf("error updating keyset %q: %v", fullName, err)
+	}
+
+	rotatedNewID := newID
+	if err := c.waitForCacheObservation(fullName, func(keyset *kops.Keyset, exists bool) bool {
+		if !exists {
+			return false
+		}
+		primary := fi.FindPrimary(keyset)
+		return primary != nil && primary.Id == rotatedNewID
+	}); err != nil {
+		return "", "", err
+	}
+
+	return oldID, newID, nil
+}
+
+// PromoteSecret makes the KeysetItem with the given id primary again, e.g.
+// to roll back a rotation within its overlap window. Since "primary" is
+// whichever item FindPrimary picks by recency, promoting re-stamps the
+// target version's material under a freshly minted Id rather than
+// reordering history.
+func (c *ClientsetSecretStore) PromoteSecret(name string, id string) error {
+	fullName := NamePrefix + name
+	keyset, err := c.clientset.Keysets(c.namespace).Get(fullName, v1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error reading keyset %q: %v", fullName, err)
+	}
+
+	var target *kops.KeysetItem
+	for i := range keyset.Spec.Keys {
+		if keyset.Spec.Keys[i].Id == id {
+			target = &keyset.Spec.Keys[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("no version %q found for secret %q", id, name)
+	}
+
+	current := fi.FindPrimary(keyset)
+	if current != nil && current.Id == id {
+		return nil
+	}
+
+	t := time.Now()
+	promotedID := pki.BuildPKISerial(t.UnixNano()).String()
+	keyset.Spec.Keys = append(keyset.Spec.Keys, kops.KeysetItem{
+		Id:              promotedID,
+		PrivateMaterial: target.PrivateMaterial,
+	})
+
+	if current != nil {
+		keyset.Annotations = setRotatedAt(keyset.Annotations, current.Id, t)
+	}
+
+	if _, err := c.clientset.Keysets(c.namespace).Update(keyset); err != nil {
+		return err
+	}
+
+	return c.waitForCacheObservation(fullName, func(keyset *kops.Keyset, exists bool) bool {
+		if !exists {
+			return false
+		}
+		primary := fi.FindPrimary(keyset)
+		return primary != nil && primary.Id == promotedID
+	})
+}
+
+// FindSecretByID returns a specific historical version of a secret, or nil
+// if the keyset or that version doesn't exist.
+func (c *ClientsetSecretStore) FindSecretByID(name string, id string) (*fi.Secret, error) {
+	fullName := NamePrefix + name
+	keyset, err := c.clientset.Keysets(c.namespace).Get(fullName, v1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading keyset %q: %v", fullName, err)
+	}
+
+	for i := range keyset.Spec.Keys {
+		item := &keyset.Spec.Keys[i]
+		if item.Id != id {
+			continue
+		}
+
+		data := item.PrivateMaterial
+		if c.encrypter != nil {
+			plaintext, wasEnveloped, err := c.encrypter.Decrypt(data)
+			if err != nil {
+				return nil, fmt.Errorf("error decrypting secret %q version %q: %v", name, id, err)
+			}
+			if wasEnveloped {
+				data = plaintext
+			}
+		}
+		return &fi.Secret{Data: data}, nil
+	}
+
+	return nil, nil
+}
+
+// ListSecretVersions returns every KeysetItem on record for name, marking
+// which one is primary.
+func (c *ClientsetSecretStore) ListSecretVersions(name string) ([]fi.SecretVersion, error) {
+	fullName := NamePrefix + name
+	keyset, err := c.clientset.Keysets(c.namespace).Get(fullName, v1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading keyset %q: %v", fullName, err)
+	}
+
+	primary := fi.FindPrimary(keyset)
+
+	var versions []fi.SecretVersion
+	for i := range keyset.Spec.Keys {
+		item := &keyset.Spec.Keys[i]
+		version := fi.SecretVersion{Id: item.Id}
+		if primary != nil && item.Id == primary.Id {
+			version.Primary = true
+		}
+		if t, ok := rotatedAt(keyset.Annotations, item.Id); ok {
+			version.RotatedAt = &t
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+// secondaryVersion is the pure-data view of a non-primary KeysetItem that
+// selectPruneTargets decides over; kept free of *kops.Keyset so the
+// selection logic is unit-testable without the Keyset API types.
+type secondaryVersion struct {
+	id        string
+	rotatedAt time.Time
+}
+
+// PruneSecrets deletes secondary (non-primary) versions of name that were
+// rotated out more than olderThan ago, always keeping at least the keep
+// most recently rotated ones. Versions with no recorded rotation time
+// (e.g. predating this feature) are never pruned automatically.
+func (c *ClientsetSecretStore) PruneSecrets(name string, keep int, olderThan time.Duration) error {
+	fullName := NamePrefix + name
+	keyset, err := c.clientset.Keysets(c.namespace).Get(fullName, v1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error reading keyset %q: %v", fullName, err)
+	}
+
+	primary := fi.FindPrimary(keyset)
+
+	var secondaries []secondaryVersion
+	for i := range keyset.Spec.Keys {
+		item := &keyset.Spec.Keys[i]
+		if primary != nil && item.Id == primary.Id {
+			continue
+		}
+		t, ok := rotatedAt(keyset.Annotations, item.Id)
+		if !ok {
+			continue
+		}
+		secondaries = append(secondaries, secondaryVersion{id: item.Id, rotatedAt: t})
+	}
+
+	remove := selectPruneTargets(secondaries, keep, olderThan, time.Now())
+	if len(remove) == 0 {
+		return nil
+	}
+
+	kept := make([]kops.KeysetItem, 0, len(keyset.Spec.Keys))
+	for _, item := range keyset.Spec.Keys {
+		if remove[item.Id] {
+			delete(keyset.Annotations, rotatedAtAnnotationPrefix+item.Id)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	keyset.Spec.Keys = kept
+
+	if _, err := c.clientset.Keysets(c.namespace).Update(keyset); err != nil {
+		return err
+	}
+
+	return c.waitForCacheObservation(fullName, func(keyset *kops.Keyset, exists bool) bool {
+		if !exists {
+			return false
+		}
+		for i := range keyset.Spec.Keys {
+			if remove[keyset.Spec.Keys[i].Id] {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// selectPruneTargets returns the ids of secondary that PruneSecrets should
+// delete: everything past the keep most-recently-rotated versions, and
+// only once it has been rotated out for at least olderThan as of now.
+func selectPruneTargets(secondary []secondaryVersion, keep int, olderThan time.Duration, now time.Time) map[string]bool {
+	sorted := make([]secondaryVersion, len(secondary))
+	copy(sorted, secondary)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].rotatedAt.After(sorted[j].rotatedAt)
+	})
+
+	remove := make(map[string]bool)
+	for i, sv := range sorted {
+		if i < keep {
+			continue
+		}
+		if now.Sub(sv.rotatedAt) < olderThan {
+			continue
+		}
+		remove[sv.id] = true
+	}
+	return remove
+}
+
+// setRotatedAt records t as the rotation time for id in annotations,
+// allocating the map if necessary, and returns it so callers can assign it
+// back to e.g. keyset.Annotations.
+func setRotatedAt(annotations map[string]string, id string, t time.Time) map[string]string {
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[rotatedAtAnnotationPrefix+id] = t.UTC().Format(time.RFC3339)
+	return annotations
+}
+
+// rotatedAt returns the rotation time recorded for id in annotations, if any.
+func rotatedAt(annotations map[string]string, id string) (time.Time, bool) {
+	v, ok := annotations[rotatedAtAnnotationPrefix+id]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
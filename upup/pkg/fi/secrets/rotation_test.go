@@ -0,0 +1,104 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetRotatedAtRoundTrip(t *testing.T) {
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	annotations := setRotatedAt(nil, "id-1", t0)
+
+	got, ok := rotatedAt(annotations, "id-1")
+	if !ok {
+		t.Fatalf("rotatedAt(%q) not found after setRotatedAt", "id-1")
+	}
+	if !got.Equal(t0) {
+		t.Errorf("rotatedAt(%q) = %v, want %v", "id-1", got, t0)
+	}
+
+	if _, ok := rotatedAt(annotations, "id-2"); ok {
+		t.Errorf("rotatedAt(%q) found an entry that was never set", "id-2")
+	}
+}
+
+func TestRotatedAtIgnoresUnparseableValue(t *testing.T) {
+	annotations := map[string]string{
+		rotatedAtAnnotationPrefix + "id-1": "not-a-timestamp",
+	}
+	if _, ok := rotatedAt(annotations, "id-1"); ok {
+		t.Errorf("rotatedAt accepted a malformed timestamp")
+	}
+}
+
+func TestSelectPruneTargetsKeepsNewestN(t *testing.T) {
+	now := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	var secondary []secondaryVersion
+	for i := 0; i < 5; i++ {
+		secondary = append(secondary, secondaryVersion{
+			id:        string(rune('a' + i)),
+			rotatedAt: now.Add(-time.Duration(i) * 48 * time.Hour),
+		})
+	}
+
+	remove := selectPruneTargets(secondary, 2, 0, now)
+
+	want := map[string]bool{"c": true, "d": true, "e": true}
+	if len(remove) != len(want) {
+		t.Fatalf("selectPruneTargets removed %v, want %v", remove, want)
+	}
+	for id := range want {
+		if !remove[id] {
+			t.Errorf("selectPruneTargets did not remove %q, want it removed", id)
+		}
+	}
+	for _, kept := range []string{"a", "b"} {
+		if remove[kept] {
+			t.Errorf("selectPruneTargets removed %q, want it kept (within keep=2)", kept)
+		}
+	}
+}
+
+func TestSelectPruneTargetsRespectsOlderThan(t *testing.T) {
+	now := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	secondary := []secondaryVersion{
+		{id: "recent", rotatedAt: now.Add(-1 * time.Hour)},
+		{id: "old", rotatedAt: now.Add(-30 * 24 * time.Hour)},
+	}
+
+	// keep=0 so age is the only thing protecting "recent" from removal.
+	remove := selectPruneTargets(secondary, 0, 7*24*time.Hour, now)
+
+	if remove["recent"] {
+		t.Errorf("selectPruneTargets removed %q, which was rotated out less than olderThan ago", "recent")
+	}
+	if !remove["old"] {
+		t.Errorf("selectPruneTargets kept %q, which was rotated out more than olderThan ago", "old")
+	}
+}
+
+func TestSelectPruneTargetsEmpty(t *testing.T) {
+	remove := selectPruneTargets(nil, 2, time.Hour, time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC))
+	if len(remove) != 0 {
+		t.Errorf("selectPruneTargets(nil) = %v, want empty", remove)
+	}
+}
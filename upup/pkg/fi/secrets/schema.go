@@ -0,0 +1,167 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"sigs.k8s.io/yaml"
+)
+
+// SecretSchema validates the shape of a secret's material before it is
+// persisted, so an operator pasting the wrong file into `kops create
+// secret` fails with a specific, actionable error instead of silently
+// storing garbage that only breaks later, on some other node.
+type SecretSchema interface {
+	// Validate returns a descriptive error if data does not match the
+	// format expected for this secret.
+	Validate(data []byte) error
+}
+
+// secretSchemas is the schema registry, keyed by logical secret name (the
+// same name passed to GetOrCreateSecret/ImportSecret).
+var secretSchemas = map[string]SecretSchema{}
+
+// RegisterSecretSchema adds or replaces the schema used to validate name.
+// Built-in schemas for well-known kops secrets are registered below;
+// cluster operators can call this to add their own.
+func RegisterSecretSchema(name string, schema SecretSchema) {
+	secretSchemas[name] = schema
+}
+
+func init() {
+	RegisterSecretSchema("admin", kubeconfigSchema{})
+	RegisterSecretSchema("kube", kubeconfigSchema{})
+	RegisterSecretSchema("kubelet", pemPrivateKeySchema{minRSABits: 2048, minECBits: 256})
+	RegisterSecretSchema("service-account", pemPrivateKeySchema{minRSABits: 2048, minECBits: 256})
+	RegisterSecretSchema("dockerconfig", dockerConfigSchema{})
+	RegisterSecretSchema("encryptionconfig", encryptionConfigSchema{})
+}
+
+// pemPrivateKeySchema requires a PEM-encoded RSA or EC private key. RSA and
+// EC keys of the same bit count aren't comparably strong -- a 256-bit EC
+// curve is roughly as strong as a ~3072-bit RSA key -- so each key type
+// gets its own minimum instead of sharing one threshold.
+type pemPrivateKeySchema struct {
+	minRSABits int
+	minECBits  int
+}
+
+func (s pemPrivateKeySchema) Validate(data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("expected a PEM-encoded private key, got %d bytes of non-PEM data", len(data))
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return checkRSAKeySize(key, s.minRSABits)
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return checkECKeySize(key, s.minECBits)
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return checkRSAKeySize(key, s.minRSABits)
+		case *ecdsa.PrivateKey:
+			return checkECKeySize(key, s.minECBits)
+		default:
+			return fmt.Errorf("unsupported private key type %T in PEM block %q", key, block.Type)
+		}
+	}
+
+	return fmt.Errorf("could not parse PEM block %q as an RSA or EC private key", block.Type)
+}
+
+func checkRSAKeySize(key *rsa.PrivateKey, minBits int) error {
+	bits := key.N.BitLen()
+	if bits < minBits {
+		return fmt.Errorf("RSA key has %d bits, expected at least %d", bits, minBits)
+	}
+	return nil
+}
+
+func checkECKeySize(key *ecdsa.PrivateKey, minBits int) error {
+	bits := key.Curve.Params().BitSize
+	if bits < minBits {
+		return fmt.Errorf("EC key has %d bits, expected at least %d", bits, minBits)
+	}
+	return nil
+}
+
+// kubeconfigSchema requires valid kubeconfig YAML with the top-level keys
+// every kubeconfig must have.
+type kubeconfigSchema struct{}
+
+func (kubeconfigSchema) Validate(data []byte) error {
+	var parsed struct {
+		Clusters []interface{} `json:"clusters"`
+		Contexts []interface{} `json:"contexts"`
+		Users    []interface{} `json:"users"`
+	}
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("expected kubeconfig YAML, got invalid YAML/JSON: %v", err)
+	}
+	if len(parsed.Clusters) == 0 || len(parsed.Contexts) == 0 || len(parsed.Users) == 0 {
+		return fmt.Errorf("expected kubeconfig YAML with clusters/contexts/users, found %d/%d/%d",
+			len(parsed.Clusters), len(parsed.Contexts), len(parsed.Users))
+	}
+	return nil
+}
+
+// dockerConfigSchema requires valid docker config.json with an "auths" map.
+type dockerConfigSchema struct{}
+
+func (dockerConfigSchema) Validate(data []byte) error {
+	var parsed struct {
+		Auths map[string]interface{} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("expected docker config.json, got invalid JSON: %v", err)
+	}
+	if len(parsed.Auths) == 0 {
+		return fmt.Errorf("expected docker config.json with a non-empty \"auths\" map")
+	}
+	return nil
+}
+
+// encryptionConfigSchema requires a valid EncryptionConfiguration, as
+// consumed by the kube-apiserver --encryption-provider-config flag.
+type encryptionConfigSchema struct{}
+
+func (encryptionConfigSchema) Validate(data []byte) error {
+	var parsed struct {
+		APIVersion string        `json:"apiVersion"`
+		Kind       string        `json:"kind"`
+		Resources  []interface{} `json:"resources"`
+	}
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("expected EncryptionConfiguration YAML, got invalid YAML/JSON: %v", err)
+	}
+	if parsed.Kind != "EncryptionConfiguration" {
+		return fmt.Errorf("expected kind \"EncryptionConfiguration\", got %q", parsed.Kind)
+	}
+	if len(parsed.Resources) == 0 {
+		return fmt.Errorf("expected EncryptionConfiguration with a non-empty \"resources\" list")
+	}
+	return nil
+}
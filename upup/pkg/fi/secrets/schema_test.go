@@ -0,0 +1,143 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package secrets
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func pemEncodeRSAKey(t *testing.T, bits int) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+func pemEncodeECKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func TestPEMPrivateKeySchemaValid(t *testing.T) {
+	schema := pemPrivateKeySchema{minRSABits: 2048, minECBits: 256}
+
+	if err := schema.Validate(pemEncodeRSAKey(t, 2048)); err != nil {
+		t.Errorf("Validate(2048-bit RSA key) = %v, want nil", err)
+	}
+	if err := schema.Validate(pemEncodeECKey(t)); err != nil {
+		t.Errorf("Validate(EC key) = %v, want nil", err)
+	}
+}
+
+func TestPEMPrivateKeySchemaRejectsNonPEM(t *testing.T) {
+	schema := pemPrivateKeySchema{minRSABits: 2048, minECBits: 256}
+	if err := schema.Validate([]byte("not a pem block at all")); err == nil {
+		t.Errorf("Validate(non-PEM data) = nil, want an error")
+	}
+}
+
+func TestPEMPrivateKeySchemaRejectsUndersizedKey(t *testing.T) {
+	schema := pemPrivateKeySchema{minRSABits: 2048, minECBits: 256}
+	if err := schema.Validate(pemEncodeRSAKey(t, 1024)); err == nil {
+		t.Errorf("Validate(1024-bit RSA key) = nil, want an error for minRSABits=2048")
+	}
+}
+
+func TestKubeconfigSchema(t *testing.T) {
+	schema := kubeconfigSchema{}
+
+	valid := []byte(`
+clusters:
+- name: cluster
+  cluster: {}
+contexts:
+- name: ctx
+  context: {}
+users:
+- name: user
+  user: {}
+`)
+	if err := schema.Validate(valid); err != nil {
+		t.Errorf("Validate(valid kubeconfig) = %v, want nil", err)
+	}
+
+	if err := schema.Validate([]byte("not: [valid")); err == nil {
+		t.Errorf("Validate(invalid YAML) = nil, want an error")
+	}
+	if err := schema.Validate([]byte("clusters: []\ncontexts: []\nusers: []\n")); err == nil {
+		t.Errorf("Validate(empty clusters/contexts/users) = nil, want an error")
+	}
+}
+
+func TestDockerConfigSchema(t *testing.T) {
+	schema := dockerConfigSchema{}
+
+	if err := schema.Validate([]byte(`{"auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz"}}}`)); err != nil {
+		t.Errorf("Validate(valid docker config) = %v, want nil", err)
+	}
+	if err := schema.Validate([]byte("not json")); err == nil {
+		t.Errorf("Validate(invalid JSON) = nil, want an error")
+	}
+	if err := schema.Validate([]byte(`{"auths":{}}`)); err == nil {
+		t.Errorf("Validate(empty auths) = nil, want an error")
+	}
+}
+
+func TestEncryptionConfigSchema(t *testing.T) {
+	schema := encryptionConfigSchema{}
+
+	valid := []byte(`
+apiVersion: apiserver.config.k8s.io/v1
+kind: EncryptionConfiguration
+resources:
+- resources:
+  - secrets
+  providers:
+  - aescbc:
+      keys:
+      - name: key1
+        secret: c2VjcmV0
+`)
+	if err := schema.Validate(valid); err != nil {
+		t.Errorf("Validate(valid EncryptionConfiguration) = %v, want nil", err)
+	}
+	if err := schema.Validate([]byte("kind: SomethingElse\nresources: [{}]\n")); err == nil {
+		t.Errorf("Validate(wrong kind) = nil, want an error")
+	}
+	if err := schema.Validate([]byte("kind: EncryptionConfiguration\nresources: []\n")); err == nil {
+		t.Errorf("Validate(empty resources) = nil, want an error")
+	}
+}